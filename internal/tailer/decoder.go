@@ -0,0 +1,64 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// byteDecoder incrementally transcodes a stream of byte chunks from a
+// File's source encoding to UTF-8.  It keeps the underlying
+// transform.Transformer's state across calls and carries forward any
+// trailing bytes that don't yet form a complete character, so that a
+// multi-byte character split across two Reads is decoded correctly
+// instead of being corrupted at the chunk boundary.
+type byteDecoder struct {
+	t       transform.Transformer
+	pending []byte // undecoded bytes left over from the previous chunk
+}
+
+// newByteDecoder returns a byteDecoder wrapping decoder.  A nil decoder
+// returns a nil *byteDecoder, whose decode is a no-op, for the common
+// case of already-UTF-8 (or ASCII) sources.
+func newByteDecoder(decoder *encoding.Decoder) *byteDecoder {
+	if decoder == nil {
+		return nil
+	}
+	return &byteDecoder{t: decoder}
+}
+
+// decode transcodes b, prepending any bytes left over from the previous
+// call.  Bytes that don't yet form a complete character are retained
+// internally and prepended to the next call's input instead of being
+// decoded, or dropped, early.
+func (d *byteDecoder) decode(b []byte) ([]byte, error) {
+	if d == nil {
+		return b, nil
+	}
+	src := append(d.pending, b...)
+	dst := make([]byte, len(src)*4+16)
+	var out []byte
+	pos := 0
+	for {
+		nDst, nSrc, err := d.t.Transform(dst, src[pos:], false)
+		out = append(out, dst[:nDst]...)
+		pos += nSrc
+		switch err {
+		case transform.ErrShortDst:
+			dst = make([]byte, len(dst)*2)
+			continue
+		case transform.ErrShortSrc:
+			// Not enough bytes yet for a complete character; keep the
+			// remainder to prepend to the next chunk.
+		case nil:
+		default:
+			d.pending = nil
+			return out, err
+		}
+		break
+	}
+	d.pending = append([]byte(nil), src[pos:]...)
+	return out, nil
+}
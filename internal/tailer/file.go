@@ -11,11 +11,11 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
-	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
 )
 
 var (
@@ -27,6 +27,8 @@ var (
 	logTruncs = expvar.NewMap("log_truncates_total")
 	// lineCount counts the numbre of lines read per log file
 	lineCount = expvar.NewMap("log_lines_total")
+	// logLinesDropped counts lines dropped by a rate limiter, per log file
+	logLinesDropped = expvar.NewMap("log_lines_dropped_total")
 )
 
 // File provides an abstraction over files and named pipes being tailed
@@ -37,18 +39,29 @@ type File struct {
 	LastRead time.Time // time of the last read received on this handle
 	regular  bool      // Remember if this is a regular file (or a pipe)
 	file     *os.File
-	partial  *bytes.Buffer
-	lock      bool  // gate to prevent watcher event from creating a race condition writing and resetting partial
+	partial  *bytes.Buffer           // unframed bytes read but not yet sent as a LogLine
+	lock     bool                    // gate to prevent watcher event from creating a race condition writing and resetting partial
 	lines    chan<- *logline.LogLine // output channel for lines read
+	limiter  *RateLimiter            // per-file leaky-bucket rate limiter, nil if unlimited
+	framer   LineFramer              // splits the byte stream read from file into records
+	decoder  *byteDecoder            // transcodes bytes read from file to UTF-8, nil if already UTF-8
 }
 
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
 // that mtail believes it's seen this pathname before, indicating we should
-// retry on error to open the file. `seekToStart` indicates that the file
-// should be tailed from offset 0, not EOF; the latter is true for rotated
-// files and for files opened when mtail is in oneshot mode.
-func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool) (*File, error) {
-	glog.V(2).Infof("file.New(%s, %v)", pathname, seekToStart)
+// retry on error to open the file. `pos` determines where in the file
+// reading should begin; StartEnd() reads only data appended from now on,
+// and StartBeginning() suits rotated files and files opened when mtail is
+// in oneshot mode.
+// `limiter`, if non-nil, caps the rate at which lines from this file are
+// forwarded. `framer` determines how the byte stream is split into
+// records; a nil framer defaults to newline-delimited records. `decoder`,
+// if non-nil, transcodes the file's bytes to UTF-8 before framing.
+func NewFile(pathname string, lines chan<- *logline.LogLine, pos StartPosition, limiter *RateLimiter, framer LineFramer, decoder *encoding.Decoder) (*File, error) {
+	glog.V(2).Infof("file.New(%s, %v)", pathname, pos)
+	if framer == nil {
+		framer = NewlineFramer{}
+	}
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
 		return nil, err
@@ -67,11 +80,7 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool) (
 	switch m := fi.Mode(); {
 	case m.IsRegular():
 		regular = true
-		seekWhence := io.SeekEnd
-		if seekToStart {
-			seekWhence = io.SeekCurrent
-		}
-		if _, err := f.Seek(0, seekWhence); err != nil {
+		if err := seekStart(f, pos); err != nil {
 			return nil, errors.Wrapf(err, "Seek failed on %q", absPath)
 		}
 		// Named pipes are the same as far as we're concerned, but we can't seek them.
@@ -80,7 +89,18 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool) (
 	default:
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, time.Now(), regular, f, bytes.NewBufferString(""), false, lines}, nil
+	return &File{
+		Name:     pathname,
+		Pathname: absPath,
+		LastRead: time.Now(),
+		regular:  regular,
+		file:     f,
+		partial:  bytes.NewBuffer(nil),
+		lines:    lines,
+		limiter:  limiter,
+		framer:   framer,
+		decoder:  newByteDecoder(decoder),
+	}, nil
 }
 
 func open(pathname string, seenBefore bool) (*os.File, error) {
@@ -162,22 +182,31 @@ func (f *File) doRotation() error {
 	return nil
 }
 
-// Read blocks of 4096 bytes from the File, sending LogLines to the given
-// channel as newlines are encountered.  If EOF is read, the partial line is
-// stored to be concatenated to on the next call.  At EOF, checks for
-// truncation and resets the file offset if so.
+// Read blocks of 4096 bytes from the File, decoding them and handing them
+// to the configured LineFramer, sending a LogLine to the output channel
+// for each complete record recognised.  Bytes not yet part of a complete
+// record are kept in `partial` to be completed by a later Read.  At EOF,
+// checks for truncation and resets the file offset if so.
 func (f *File) Read() error {
-	b := make([]byte, 0, 4096)
+	b := make([]byte, 4096)
 	totalBytes := 0
 	for {
 		f.lock = true
 		if err := f.file.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
 			glog.V(2).Infof("%s: %s", f.Name, err)
 		}
-		n, err := f.file.Read(b[:cap(b)])
+		n, err := f.file.Read(b)
 		glog.V(2).Infof("Read count %v err %v", n, err)
 		totalBytes += n
-		b = b[:n]
+
+		if n > 0 {
+			decoded, derr := f.decoder.decode(b[:n])
+			if derr != nil {
+				glog.Infof("%s: error decoding bytes: %s", f.Name, derr)
+			}
+			f.partial.Write(decoded)
+			f.drainLines()
+		}
 
 		// If this time we've read no bytes at all and then hit an EOF, and
 		// we're a regular file, check for truncation.
@@ -193,20 +222,6 @@ func (f *File) Read() error {
 			}
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				f.waitForLock()
-				f.partial.WriteRune(rune)
-			default:
-				f.sendLine()
-			}
-		}
 		f.lock = false
 		// Return on any error, including EOF.
 		if err != nil {
@@ -219,21 +234,53 @@ func (f *File) Read() error {
 	}
 }
 
-func (f *File) waitForLock() {
-	if f.partialLock {
-		time.Sleep(1 * time.Millisecond)
+// drainLines repeatedly asks the File's LineFramer for a complete record
+// at the head of partial, sending each one it finds, until the framer
+// reports there isn't enough buffered data for another.
+func (f *File) drainLines() {
+	for {
+		line, consumed, ok := f.framer.Frame(f.partial.Bytes())
+		if !ok {
+			return
+		}
+		f.sendLine(line)
+		f.partial.Next(consumed)
 	}
 }
 
-// sendLine sends the contents of the partial buffer off for processing.
-func (f *File) sendLine() {
-	f.partialLock = true
-	f.lines <- logline.NewLogLine(f.Name, f.partial.String())
+// sendLine sends a framed record off for processing.  If a per-file or
+// aggregate rate limit is in effect and has been exceeded, the line is
+// dropped instead (or, if the limiter is configured to block, sendLine
+// waits until capacity is available).  The aggregate limiter is consulted
+// first so that a line the aggregate cap is going to drop anyway never
+// debits the per-file bucket too; if the per-file limiter then drops the
+// line, the aggregate debit is refunded so it isn't charged for a line
+// never forwarded either.
+func (f *File) sendLine(line []byte) {
+	if !globalLimiter().Allow() {
+		logLinesDropped.Add(f.Name, 1)
+		return
+	}
+	if !f.limiter.Allow() {
+		globalLimiter().Refund()
+		logLinesDropped.Add(f.Name, 1)
+		return
+	}
+	f.lines <- logline.NewLogLine(f.Name, string(line))
 	lineCount.Add(f.Name, 1)
 	glog.V(2).Info("Line sent")
-	// reset partial accumulator
+}
+
+// flushPartial sends whatever unframed bytes remain in partial as a final
+// record, for use when the file is about to be truncated, rotated away
+// from, or closed, and no further bytes are coming to complete the
+// framing.
+func (f *File) flushPartial() {
+	if f.partial.Len() == 0 {
+		return
+	}
+	f.sendLine(f.partial.Bytes())
 	f.partial.Reset()
-	f.partialLock = false
 }
 
 // checkForTruncate checks to see if the current offset into the file
@@ -259,9 +306,7 @@ func (f *File) checkForTruncate() (bool, error) {
 
 	// We're about to lose all data because of the truncate so if there's
 	// anything in the buffer, send it out.
-	if f.partial.Len() > 0 {
-		f.sendLine()
-	}
+	f.flushPartial()
 
 	p, serr := f.file.Seek(0, io.SeekStart)
 	glog.V(2).Infof("Truncated?  Seeked to %d: %v", p, serr)
@@ -274,8 +319,6 @@ func (f *File) Stat() (os.FileInfo, error) {
 }
 
 func (f *File) Close() error {
-	if f.partial.Len() > 0 {
-		f.sendLine()
-	}
+	f.flushPartial()
 	return f.file.Close()
 }
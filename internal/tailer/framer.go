@@ -0,0 +1,107 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+)
+
+// LineFramer splits a stream of decoded bytes into discrete records.
+// Frame attempts to extract one complete record from the head of buf,
+// returning the record, how many bytes of buf it consumed, and whether a
+// complete record was found.  If ok is false, the caller should read more
+// bytes into buf and try again.
+type LineFramer interface {
+	Frame(buf []byte) (line []byte, consumed int, ok bool)
+}
+
+// NewlineFramer splits records on '\n', mtail's original behaviour.
+type NewlineFramer struct{}
+
+// Frame implements the LineFramer interface.
+func (NewlineFramer) Frame(buf []byte) ([]byte, int, bool) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx < 0 {
+		return nil, 0, false
+	}
+	return buf[:idx], idx + 1, true
+}
+
+// NullByteFramer splits records on a NUL byte, for NUL-delimited pipelines
+// such as `find -print0`.
+type NullByteFramer struct{}
+
+// Frame implements the LineFramer interface.
+func (NullByteFramer) Frame(buf []byte) ([]byte, int, bool) {
+	idx := bytes.IndexByte(buf, 0)
+	if idx < 0 {
+		return nil, 0, false
+	}
+	return buf[:idx], idx + 1, true
+}
+
+// RegexpContinuationFramer assembles multi-line records, such as Java or
+// Python stack traces, by treating any line matching start as the
+// beginning of a new record and appending subsequent lines that don't
+// match start to it, until the next line that does.  Frame reports a
+// record complete only once that next start line is buffered; the last
+// record is left unframed for File to flush on truncation or close.
+type RegexpContinuationFramer struct {
+	start *regexp.Regexp
+}
+
+// NewRegexpContinuationFramer returns a RegexpContinuationFramer that
+// begins a new record on any line matching start.
+func NewRegexpContinuationFramer(start *regexp.Regexp) *RegexpContinuationFramer {
+	return &RegexpContinuationFramer{start: start}
+}
+
+// Frame implements the LineFramer interface.
+func (r *RegexpContinuationFramer) Frame(buf []byte) ([]byte, int, bool) {
+	var nl NewlineFramer
+	first, consumed, ok := nl.Frame(buf)
+	if !ok {
+		return nil, 0, false
+	}
+	if !r.start.Match(first) {
+		// A continuation line with no preceding record start; emit it
+		// alone rather than silently dropping it.
+		return first, consumed, true
+	}
+	total := consumed
+	for {
+		next, nconsumed, ok := nl.Frame(buf[total:])
+		if !ok {
+			return nil, 0, false
+		}
+		if r.start.Match(next) {
+			// total is the offset of the line that starts the next
+			// record; trim the newline that terminates this one.
+			return buf[:total-1], total, true
+		}
+		total += nconsumed
+	}
+}
+
+// lengthPrefixSize is the width, in bytes, of the length header
+// LengthPrefixedFramer expects before each record.
+const lengthPrefixSize = 4
+
+// LengthPrefixedFramer frames records as a big-endian uint32 byte count
+// followed by that many bytes of payload, for framed binary logs.
+type LengthPrefixedFramer struct{}
+
+// Frame implements the LineFramer interface.
+func (LengthPrefixedFramer) Frame(buf []byte) ([]byte, int, bool) {
+	if len(buf) < lengthPrefixSize {
+		return nil, 0, false
+	}
+	n := int(binary.BigEndian.Uint32(buf[:lengthPrefixSize]))
+	if len(buf) < lengthPrefixSize+n {
+		return nil, 0, false
+	}
+	return buf[lengthPrefixSize : lengthPrefixSize+n], lengthPrefixSize + n, true
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRegexpContinuationFramer(t *testing.T) {
+	start := regexp.MustCompile(`^\d+-\d+-\d+`)
+	r := NewRegexpContinuationFramer(start)
+
+	buf := []byte("2018-01-01 start\n  continuation one\n  continuation two\n2018-01-02 next\n")
+
+	line, consumed, ok := r.Frame(buf)
+	if !ok {
+		t.Fatal("Frame() = false on a buffer containing a complete record, want true")
+	}
+	want := "2018-01-01 start\n  continuation one\n  continuation two"
+	if string(line) != want {
+		t.Errorf("Frame() line = %q, want %q", line, want)
+	}
+
+	// The second record is the last thing in buf, with no following
+	// start line to confirm it's complete; like any trailing partial
+	// record, it's only emitted later via flushPartial, not by Frame.
+	if _, _, ok := r.Frame(buf[consumed:]); ok {
+		t.Error("Frame() = true on a buffer with no following record start, want false")
+	}
+
+	buf2 := append(append([]byte{}, buf[consumed:]...), []byte("2018-01-03 another\n")...)
+	line2, _, ok := r.Frame(buf2)
+	if !ok {
+		t.Fatal("Frame() = false once the second record's end is confirmed by a following start line, want true")
+	}
+	if string(line2) != "2018-01-02 next" {
+		t.Errorf("Frame() second line = %q, want %q", line2, "2018-01-02 next")
+	}
+}
+
+func TestRegexpContinuationFramerIncomplete(t *testing.T) {
+	start := regexp.MustCompile(`^\d+-\d+-\d+`)
+	r := NewRegexpContinuationFramer(start)
+
+	// No record-starting line yet follows the continuation, so there's
+	// no way to know the record is complete.
+	buf := []byte("2018-01-01 start\n  continuation\n")
+	if _, _, ok := r.Frame(buf); ok {
+		t.Error("Frame() = true on a buffer with no following record start, want false")
+	}
+}
+
+func TestRegexpContinuationFramerLeadingContinuation(t *testing.T) {
+	start := regexp.MustCompile(`^\d+-\d+-\d+`)
+	r := NewRegexpContinuationFramer(start)
+
+	buf := []byte("  orphan continuation\n2018-01-01 start\n")
+	line, consumed, ok := r.Frame(buf)
+	if !ok {
+		t.Fatal("Frame() = false, want true")
+	}
+	if string(line) != "  orphan continuation" {
+		t.Errorf("Frame() line = %q, want the orphan line emitted alone", line)
+	}
+	if consumed != len("  orphan continuation\n") {
+		t.Errorf("Frame() consumed = %d, want %d", consumed, len("  orphan continuation\n"))
+	}
+}
+
+func TestLengthPrefixedFramer(t *testing.T) {
+	var f LengthPrefixedFramer
+
+	// Too short for even the length header.
+	if _, _, ok := f.Frame([]byte{0, 0, 0}); ok {
+		t.Error("Frame() = true on a buffer shorter than the length prefix, want false")
+	}
+
+	// Header present but payload not fully buffered yet.
+	buf := []byte{0, 0, 0, 5, 'h', 'e'}
+	if _, _, ok := f.Frame(buf); ok {
+		t.Error("Frame() = true on a buffer with a short payload, want false")
+	}
+
+	buf = append(buf, 'l', 'l', 'o', 'X')
+	line, consumed, ok := f.Frame(buf)
+	if !ok {
+		t.Fatal("Frame() = false on a complete record, want true")
+	}
+	if string(line) != "hello" {
+		t.Errorf("Frame() line = %q, want %q", line, "hello")
+	}
+	if consumed != 9 {
+		t.Errorf("Frame() consumed = %d, want 9", consumed)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	lineRateBurst  = flag.Int("tail_rate_limit_burst", 0, "Maximum number of lines permitted in a burst before per-file rate limiting begins.  0 disables per-file rate limiting.")
+	lineRateRefill = flag.Float64("tail_rate_limit_refill", 0, "Refill rate, in lines per second, for the per-file leaky-bucket rate limiter.")
+	lineRateBlock  = flag.Bool("tail_rate_limit_block", false, "If true, block instead of dropping lines once a rate limit is exceeded.")
+
+	globalRateBurst  = flag.Int("tail_global_rate_limit_burst", 0, "Maximum aggregate number of lines permitted in a burst, summed across all tailed files.  0 disables the aggregate rate limiter.")
+	globalRateRefill = flag.Float64("tail_global_rate_limit_refill", 0, "Aggregate refill rate, in lines per second, summed across all tailed files.")
+	globalRateBlock  = flag.Bool("tail_global_rate_limit_block", false, "If true, block instead of dropping lines once the aggregate rate limit is exceeded.")
+)
+
+// RateLimiter implements a leaky-bucket rate limit on the rate at which
+// lines may be forwarded, so that a runaway log cannot swamp the rest of
+// the mtail pipeline.  It is safe for concurrent use.
+type RateLimiter struct {
+	mu          sync.Mutex
+	level       float64   // current bucket level, in lines
+	lastUpdated time.Time // time level was last drained
+	burst       float64   // maximum bucket level, in lines
+	refill      float64   // drain rate, in lines per second
+	block       bool      // if true, Allow blocks instead of returning false
+}
+
+// NewRateLimiter returns a RateLimiter permitting a burst of burst lines,
+// refilling at refill lines per second.  If block is true, Allow blocks
+// until capacity is available instead of reporting the line as dropped.
+func NewRateLimiter(burst int, refill float64, block bool) *RateLimiter {
+	return &RateLimiter{
+		burst:       float64(burst),
+		refill:      refill,
+		block:       block,
+		lastUpdated: time.Now(),
+	}
+}
+
+// Allow reports whether a line may be forwarded now, and advances the
+// bucket level as a side effect.  A nil RateLimiter always allows.
+func (r *RateLimiter) Allow() bool {
+	if r == nil || r.refill <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		now := time.Now()
+		r.level -= now.Sub(r.lastUpdated).Seconds() * r.refill
+		if r.level < 0 {
+			r.level = 0
+		}
+		r.lastUpdated = now
+		if r.level+1 <= r.burst {
+			r.level++
+			return true
+		}
+		if !r.block {
+			return false
+		}
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		r.mu.Lock()
+	}
+}
+
+// Refund undoes a single line previously counted by Allow, for use when a
+// later check (such as a second, independent limiter) decides the line
+// won't be forwarded after all.  A nil RateLimiter is a no-op.
+func (r *RateLimiter) Refund() {
+	if r == nil || r.refill <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.level--
+	if r.level < 0 {
+		r.level = 0
+	}
+	r.mu.Unlock()
+}
+
+// NewRateLimiterFromFlags returns the per-file RateLimiter described by the
+// tail_rate_limit_* flags, or nil if per-file rate limiting is disabled.
+func NewRateLimiterFromFlags() *RateLimiter {
+	if *lineRateBurst <= 0 || *lineRateRefill <= 0 {
+		return nil
+	}
+	return NewRateLimiter(*lineRateBurst, *lineRateRefill, *lineRateBlock)
+}
+
+var (
+	globalLimiterOnce sync.Once
+	globalLimiterVal  *RateLimiter
+)
+
+// globalLimiter lazily constructs the aggregate RateLimiter shared by every
+// File, so that the sum of lines across all tailed files can also be
+// capped, based on the tail_global_rate_limit_* flags.
+func globalLimiter() *RateLimiter {
+	globalLimiterOnce.Do(func() {
+		if *globalRateBurst <= 0 || *globalRateRefill <= 0 {
+			return
+		}
+		globalLimiterVal = NewRateLimiter(*globalRateBurst, *globalRateRefill, *globalRateBlock)
+	})
+	return globalLimiterVal
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "testing"
+
+func TestRateLimiterAllowsBurstThenDrops(t *testing.T) {
+	// A refill rate small enough that none of it replenishes over the
+	// lifetime of this test, so only the burst size governs how many
+	// calls are allowed.
+	r := NewRateLimiter(3, 1e-9, false)
+	for i := 0; i < 3; i++ {
+		if !r.Allow() {
+			t.Fatalf("Allow() = false within burst at line %d, want true", i)
+		}
+	}
+	if r.Allow() {
+		t.Error("Allow() = true once the burst is exhausted, want false")
+	}
+}
+
+func TestRateLimiterDisabledWhenRefillIsZero(t *testing.T) {
+	r := NewRateLimiter(0, 0, false)
+	for i := 0; i < 100; i++ {
+		if !r.Allow() {
+			t.Fatalf("Allow() = false with a zero-refill limiter at iteration %d, want true (unlimited)", i)
+		}
+	}
+}
+
+func TestNilRateLimiterAlwaysAllows(t *testing.T) {
+	var r *RateLimiter
+	if !r.Allow() {
+		t.Error("Allow() on a nil RateLimiter = false, want true")
+	}
+}
+
+func TestRateLimiterRefundRestoresBurstCapacity(t *testing.T) {
+	r := NewRateLimiter(3, 1e-9, false)
+	for i := 0; i < 3; i++ {
+		if !r.Allow() {
+			t.Fatalf("Allow() = false within burst at line %d, want true", i)
+		}
+	}
+	r.Refund()
+	if !r.Allow() {
+		t.Error("Allow() = false after Refund() freed a slot, want true")
+	}
+	if r.Allow() {
+		t.Error("Allow() = true once the burst is exhausted again, want false")
+	}
+}
+
+func TestNilRateLimiterRefundIsNoOp(t *testing.T) {
+	var r *RateLimiter
+	r.Refund()
+}
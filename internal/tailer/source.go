@@ -0,0 +1,222 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/watcher"
+	"github.com/pkg/errors"
+)
+
+// globMatchCount reports, per configured glob pattern, how many pathnames
+// it currently resolves to.
+var globMatchCount = expvar.NewMap("log_glob_matches")
+
+// Source represents one configured log source: a pathname or glob pattern
+// (e.g. `/var/log/nginx/*.access.log`, `/var/log/**/app-*.log`) that is
+// expanded to zero or more Files.  The pattern's non-glob prefix directory
+// is watched, non-recursively, so that Files are created as matches appear
+// directly in it; each matched file is watched so that its File is closed
+// when it disappears.  Matches that appear after Run starts in deeper
+// subdirectories (as with `**` or a glob in a directory component) are not
+// picked up.
+type Source struct {
+	pattern    string
+	lines      chan<- *logline.LogLine
+	w          *watcher.LogWatcher
+	newLimiter func() *RateLimiter
+
+	handle int // event handle shared by the directory watch and every matched file's watch
+
+	mu    sync.Mutex
+	files map[string]*File // currently tailed Files, keyed by absolute pathname
+}
+
+// NewSource creates a Source for pattern, validating it but not yet
+// performing any glob expansion or watching; call Run to start tailing.
+// newLimiter, if non-nil, is called once per matched file to build that
+// file's own independent rate limiter, so that a glob matching several
+// files doesn't make them all share a single bucket.
+func NewSource(pattern string, lines chan<- *logline.LogLine, w *watcher.LogWatcher, newLimiter func() *RateLimiter) (*Source, error) {
+	// Matches are keyed by absolute pathname, the form watcher events use.
+	pattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePattern(pattern); err != nil {
+		return nil, err
+	}
+	return &Source{
+		pattern:    pattern,
+		lines:      lines,
+		w:          w,
+		newLimiter: newLimiter,
+		files:      make(map[string]*File),
+	}, nil
+}
+
+// validatePattern rejects patterns whose non-glob prefix does not exist, so
+// that a typo'd directory is reported at startup instead of silently
+// matching nothing forever.
+func validatePattern(pattern string) error {
+	prefix := nonGlobPrefix(pattern)
+	if prefix == "" {
+		return nil
+	}
+	if _, err := os.Stat(prefix); err != nil {
+		return errors.Wrapf(err, "glob pattern %q: non-glob prefix %q", pattern, prefix)
+	}
+	return nil
+}
+
+// nonGlobPrefix returns the longest leading directory of pattern that
+// contains no glob metacharacters, so it can be watched and validated.
+func nonGlobPrefix(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for containsGlobMeta(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+func containsGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// Run expands the Source's pattern, starts tailing every current match,
+// then watches the pattern's non-glob prefix directory for new matches to
+// appear directly in it or existing matches to be removed.  Run blocks on the watcher's
+// event channel, so callers should invoke it in its own goroutine.
+func (s *Source) Run() error {
+	handle, events := s.w.Events()
+	s.handle = handle
+
+	matches, err := s.expand()
+	if err != nil {
+		return err
+	}
+	for _, pathname := range matches {
+		if err := s.startTailing(pathname); err != nil {
+			glog.Infof("Failed to start tailing %q: %s", pathname, err)
+		}
+	}
+	s.updateMatchCount()
+
+	dir := nonGlobPrefix(s.pattern)
+	if dir == "" {
+		dir = "."
+	}
+	if err := s.w.Add(dir, handle); err != nil {
+		return errors.Wrapf(err, "Failed to watch %q for pattern %q", dir, s.pattern)
+	}
+
+	for e := range events {
+		switch e.Op {
+		case watcher.Create:
+			s.handleCreate(e.Pathname)
+		case watcher.Update:
+			s.handleUpdate(e.Pathname)
+		case watcher.Delete:
+			s.handleDelete(e.Pathname)
+		}
+	}
+	return nil
+}
+
+// expand resolves the Source's pattern to the pathnames it currently
+// matches, using doublestar so that `**` patterns also match recursively.
+func (s *Source) expand() ([]string, error) {
+	matches, err := doublestar.Glob(s.pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "glob %q", s.pattern)
+	}
+	return matches, nil
+}
+
+func (s *Source) handleCreate(pathname string) {
+	ok, err := doublestar.Match(s.pattern, pathname)
+	if err != nil || !ok {
+		return
+	}
+	if err := s.startTailing(pathname); err != nil {
+		glog.Infof("Failed to start tailing %q: %s", pathname, err)
+	}
+	s.updateMatchCount()
+}
+
+// handleUpdate is called when a watched file has new content; it drives
+// the matching File's Follow so the new bytes actually get read and
+// forwarded, mirroring what a single-file tailer would do directly.
+func (s *Source) handleUpdate(pathname string) {
+	s.mu.Lock()
+	f, ok := s.files[pathname]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := f.Follow(); err != nil {
+		glog.Infof("Follow failed on %q: %s", pathname, err)
+	}
+}
+
+func (s *Source) handleDelete(pathname string) {
+	s.mu.Lock()
+	f, ok := s.files[pathname]
+	delete(s.files, pathname)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := f.Close(); err != nil {
+		glog.Infof("Failed to close %q: %s", pathname, err)
+	}
+	s.updateMatchCount()
+}
+
+// startTailing begins tailing pathname, if it is not already being
+// tailed, registering a watch on the file itself so that the Source
+// learns of subsequent writes to it (the kqueue backend's directory watch
+// reports only entries being created and removed, and the poll ticker
+// sends Updates only for watched paths themselves).
+func (s *Source) startTailing(pathname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[pathname]; ok {
+		return nil
+	}
+	var limiter *RateLimiter
+	if s.newLimiter != nil {
+		limiter = s.newLimiter()
+	}
+	f, err := NewFile(pathname, s.lines, StartEnd(), limiter, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.w.Add(pathname, s.handle); err != nil {
+		return errors.Wrapf(err, "Failed to watch %q", pathname)
+	}
+	s.files[pathname] = f
+	return nil
+}
+
+func (s *Source) updateMatchCount() {
+	s.mu.Lock()
+	n := len(s.files)
+	s.mu.Unlock()
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	globMatchCount.Set(s.pattern, v)
+}
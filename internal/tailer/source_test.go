@@ -0,0 +1,193 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/watcher"
+)
+
+// newTestSource returns a Source for pattern backed by a real LogWatcher,
+// with the directory-watch handle already assigned the way Run would
+// assign it, so startTailing and the handle* methods can be exercised
+// directly without running the Source's event loop.
+func newTestSource(t *testing.T, pattern string, lines chan *logline.LogLine) *Source {
+	t.Helper()
+	w, err := watcher.NewLogWatcher(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	s, err := NewSource(pattern, lines, w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, events := w.Events()
+	s.handle = handle
+	// These tests call handleCreate/handleDelete/startTailing directly
+	// instead of running Source's own event loop (Run), so nothing else
+	// drains this channel; without a drainer, a stray watcher event (e.g.
+	// a Chmod notification from merely opening a watched file) blocks the
+	// watcher's internal dispatch goroutine and wedges w.Close() above.
+	go func() {
+		for range events {
+		}
+	}()
+	return s
+}
+
+func TestNonGlobPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		want    string
+	}{
+		{"no glob", "/var/log/syslog", "/var/log"},
+		{"star in base", "/var/log/*.log", "/var/log"},
+		{"doublestar", "/var/log/**/app.log", "/var/log"},
+		{"glob in middle dir", "/var/[a-z]og/app.log", "/var"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := nonGlobPrefix(tc.pattern); got != tc.want {
+				t.Errorf("nonGlobPrefix(%q) = %q, want %q", tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := validatePattern(filepath.Join(dir, "*.log")); err != nil {
+		t.Errorf("validatePattern() = %v for a pattern whose non-glob prefix exists, want nil", err)
+	}
+	if err := validatePattern(filepath.Join(dir, "nonexistent", "*.log")); err == nil {
+		t.Error("validatePattern() = nil for a non-glob prefix that doesn't exist, want an error")
+	}
+}
+
+func TestSourceExpandAtStartup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan *logline.LogLine, 10)
+	s := newTestSource(t, filepath.Join(dir, "*.log"), lines)
+
+	matches, err := s.expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		filepath.Join(dir, "a.log"): true,
+		filepath.Join(dir, "b.log"): true,
+	}
+	if len(matches) != len(want) {
+		t.Fatalf("expand() = %v, want exactly %v", matches, want)
+	}
+	for _, m := range matches {
+		if !want[m] {
+			t.Errorf("expand() matched %q, which doesn't end in .log", m)
+		}
+	}
+}
+
+func TestSourceHandleCreateStartsTailing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "new.log")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan *logline.LogLine, 10)
+	s := newTestSource(t, filepath.Join(dir, "*.log"), lines)
+
+	s.handleCreate(path)
+
+	s.mu.Lock()
+	_, ok := s.files[path]
+	s.mu.Unlock()
+	if !ok {
+		t.Errorf("handleCreate(%q) did not start tailing a file matching the pattern", path)
+	}
+}
+
+func TestSourceHandleCreateIgnoresNonMatchingPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "new.txt")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan *logline.LogLine, 10)
+	s := newTestSource(t, filepath.Join(dir, "*.log"), lines)
+
+	s.handleCreate(path)
+
+	s.mu.Lock()
+	_, ok := s.files[path]
+	s.mu.Unlock()
+	if ok {
+		t.Errorf("handleCreate(%q) started tailing a path that doesn't match the pattern", path)
+	}
+}
+
+func TestSourceHandleDeleteStopsTailing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gone.log")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan *logline.LogLine, 10)
+	s := newTestSource(t, filepath.Join(dir, "*.log"), lines)
+
+	if err := s.startTailing(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s.handleDelete(path)
+
+	s.mu.Lock()
+	_, ok := s.files[path]
+	s.mu.Unlock()
+	if ok {
+		t.Errorf("handleDelete(%q) left the file in the tailed set after deletion", path)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+type startKind int
+
+const (
+	startEnd startKind = iota
+	startBeginning
+	startLastN
+	startSince
+)
+
+// TimestampExtractor parses the timestamp from the start of a log line. It
+// reports ok=false if the line has no parseable timestamp.
+type TimestampExtractor func(line []byte) (ts time.Time, ok bool)
+
+// StartPosition describes where in a file NewFile should begin reading.
+type StartPosition struct {
+	kind    startKind
+	n       int
+	since   time.Duration
+	extract TimestampExtractor
+}
+
+// StartEnd begins reading at the end of the file, so only new data is
+// read.  This is the default used for already-known files.
+func StartEnd() StartPosition { return StartPosition{kind: startEnd} }
+
+// StartBeginning begins reading from the start of the file.
+func StartBeginning() StartPosition { return StartPosition{kind: startBeginning} }
+
+// StartLastN begins reading from the nth-from-last line in the file, or
+// from the beginning if the file has fewer than n lines.
+func StartLastN(n int) StartPosition { return StartPosition{kind: startLastN, n: n} }
+
+// StartSince begins reading from the first line whose timestamp, as parsed
+// by extract, is at or after time.Now().Add(-d).  If no line's timestamp
+// can be determined, it falls back to the beginning of the file.
+func StartSince(d time.Duration, extract TimestampExtractor) StartPosition {
+	return StartPosition{kind: startSince, since: d, extract: extract}
+}
+
+// seekStart positions a freshly-opened regular file according to pos.  It
+// is not called for named pipes, which cannot be seeked.
+func seekStart(f *os.File, pos StartPosition) error {
+	switch pos.kind {
+	case startBeginning:
+		_, err := f.Seek(0, io.SeekStart)
+		return err
+	case startLastN:
+		return seekLastN(f, pos.n)
+	case startSince:
+		return seekSince(f, time.Now().Add(-pos.since), pos.extract)
+	default:
+		_, err := f.Seek(0, io.SeekEnd)
+		return err
+	}
+}
+
+const seekBlockSize = 4096
+
+// seekLastN seeks f to the offset just after the nth-from-last newline, by
+// reading backward from EOF in blocks of seekBlockSize bytes.  A trailing
+// newline, as any well-formed log file ends with, terminates the last
+// line rather than separating it from the one before, so it is skipped
+// and not counted as one of the n boundaries.  If f has fewer than n
+// lines, it seeks to the beginning instead.
+func seekLastN(f *os.File, n int) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		_, err := f.Seek(0, io.SeekStart)
+		return err
+	}
+	buf := make([]byte, seekBlockSize)
+	newlines := 0
+	pos := size
+	skipTrailingNewline := true
+	for pos > 0 {
+		readSize := int64(seekBlockSize)
+		if pos < readSize {
+			readSize = pos
+		}
+		pos -= readSize
+		nread, rerr := f.ReadAt(buf[:readSize], pos)
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		for i := nread - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				continue
+			}
+			if skipTrailingNewline && pos+int64(i) == size-1 {
+				skipTrailingNewline = false
+				continue
+			}
+			skipTrailingNewline = false
+			newlines++
+			if newlines == n {
+				_, err := f.Seek(pos+int64(i)+1, io.SeekStart)
+				return err
+			}
+		}
+	}
+	// Fewer than n lines in the file; tail from the start.
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// seekSince binary-searches f for the first line with a timestamp at or
+// after cutoff, using extract to parse each candidate line.
+func seekSince(f *os.File, cutoff time.Time, extract TimestampExtractor) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, serr := lineStart(f, mid)
+		if serr != nil {
+			break
+		}
+		line, rerr := readLine(f, start, size)
+		if rerr != nil {
+			break
+		}
+		ts, ok := extract(line)
+		if !ok {
+			// Can't order by timestamp from here; give up the search and
+			// start at the earliest candidate found so far.
+			break
+		}
+		if ts.Before(cutoff) {
+			lo = start + int64(len(line)) + 1
+			if lo > hi {
+				lo = hi
+			}
+		} else {
+			hi = start
+		}
+	}
+	_, err = f.Seek(lo, io.SeekStart)
+	return err
+}
+
+// lineStart returns the offset of the start of the line containing byte
+// offset off, by scanning backward in blocks for the preceding newline.
+func lineStart(f *os.File, off int64) (int64, error) {
+	buf := make([]byte, seekBlockSize)
+	pos := off
+	for pos > 0 {
+		readSize := int64(seekBlockSize)
+		if pos < readSize {
+			readSize = pos
+		}
+		pos -= readSize
+		n, err := f.ReadAt(buf[:readSize], pos)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if idx := bytes.LastIndexByte(buf[:n], '\n'); idx >= 0 {
+			return pos + int64(idx) + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// readLine reads the line beginning at offset off, up to the next newline
+// or size, whichever comes first.
+func readLine(f *os.File, off, size int64) ([]byte, error) {
+	var line []byte
+	pos := off
+	for pos < size {
+		readSize := int64(seekBlockSize)
+		if size-pos < readSize {
+			readSize = size - pos
+		}
+		chunk := make([]byte, readSize)
+		n, err := f.ReadAt(chunk, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if idx := bytes.IndexByte(chunk[:n], '\n'); idx >= 0 {
+			return append(line, chunk[:idx]...), nil
+		}
+		line = append(line, chunk[:n]...)
+		pos += int64(n)
+	}
+	return line, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTempFile(t *testing.T, contents string) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "start_position_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func readRemainder(t *testing.T, f *os.File) string {
+	t.Helper()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSeekLastN(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"zero", 0, "one\ntwo\nthree\n"},
+		{"one", 1, "three\n"},
+		{"two", 2, "two\nthree\n"},
+		{"more than available", 10, "one\ntwo\nthree\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := writeTempFile(t, "one\ntwo\nthree\n")
+			if err := seekLastN(f, tc.n); err != nil {
+				t.Fatal(err)
+			}
+			if got := readRemainder(t, f); got != tc.want {
+				t.Errorf("seekLastN(%d) left file at %q, want %q", tc.n, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSeekLastNAcrossBlockBoundary(t *testing.T) {
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, strconv.Itoa(i))
+	}
+	contents := strings.Join(lines, "\n") + "\n"
+	f := writeTempFile(t, contents)
+	if err := seekLastN(f, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := "1997\n1998\n1999\n"
+	if got := readRemainder(t, f); got != want {
+		t.Errorf("seekLastN(3) left file at %q, want %q", got, want)
+	}
+}
+
+func timestampExtractor(layout string) TimestampExtractor {
+	return func(line []byte) (time.Time, bool) {
+		fields := strings.SplitN(string(line), " ", 2)
+		ts, err := time.Parse(layout, fields[0])
+		if err != nil {
+			return time.Time{}, false
+		}
+		return ts, true
+	}
+}
+
+func TestSeekSince(t *testing.T) {
+	const layout = "2006-01-02T15:04:05"
+	now := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		ts := now.Add(time.Duration(i) * time.Minute)
+		lines = append(lines, ts.Format(layout)+" line "+strconv.Itoa(i))
+	}
+	contents := strings.Join(lines, "\n") + "\n"
+	f := writeTempFile(t, contents)
+
+	cutoff := now.Add(10*time.Minute + 30*time.Second)
+	if err := seekSince(f, cutoff, timestampExtractor(layout)); err != nil {
+		t.Fatal(err)
+	}
+	remainder := readRemainder(t, f)
+	want := now.Add(11*time.Minute).Format(layout) + " line 11\n"
+	if !strings.HasPrefix(remainder, want) {
+		t.Errorf("seekSince left file at %q, want prefix %q", remainder, want)
+	}
+}
+
+func TestSeekSinceUnparseableFallsBackToEarliestCandidate(t *testing.T) {
+	contents := "not a timestamp\nstill not one\nnor this\n"
+	f := writeTempFile(t, contents)
+	if err := seekSince(f, time.Now(), timestampExtractor(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRemainder(t, f); got != contents {
+		t.Errorf("seekSince left file at %q, want the whole file %q", got, contents)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// programReloadErrors counts the number of times a changed program file
+// failed its syntax check and was not reloaded.
+var programReloadErrors = expvar.NewInt("program_reload_errors_total")
+
+// programSuffix is the extension mtail program files are expected to have.
+const programSuffix = ".mtail"
+
+// ProgramEventOp describes what happened to a watched program file.
+type ProgramEventOp int
+
+const (
+	// ProgramAdded indicates a new program file appeared in the watched directory.
+	ProgramAdded ProgramEventOp = iota
+	// ProgramChanged indicates an existing program file's contents were
+	// rewritten and the new source passed its syntax check.
+	ProgramChanged
+	// ProgramRemoved indicates a program file was deleted from the watched directory.
+	ProgramRemoved
+)
+
+// ProgramEvent describes a single change to a program file.
+type ProgramEvent struct {
+	Op       ProgramEventOp
+	Pathname string
+}
+
+// ProgramChecker reports whether the program source at pathname is
+// syntactically valid.  ConfWatcher uses it to avoid replacing a working
+// program with a broken one while an editor save is still in progress.
+type ProgramChecker func(pathname string) error
+
+// ConfWatcher watches a directory of .mtail program files and emits typed
+// ProgramEvents for the VM loader to consume, so that individual programs
+// can be recompiled and swapped in without a full mtail restart.  It
+// reuses the fsnotify plumbing LogWatcher is built on, adapted to debounce
+// editor saves and syntax-check new source before announcing it.
+type ConfWatcher struct {
+	confDir  string
+	check    ProgramChecker
+	debounce time.Duration
+
+	watcher *fsnotify.Watcher
+	events  chan ProgramEvent
+
+	pendingMu sync.Mutex
+	pending   map[string]*time.Timer // debounce timers, by pathname
+	syncWG    sync.WaitGroup         // tracks in-flight syncProgram calls, so Close can wait for them
+
+	seenMu sync.Mutex
+	seen   map[string]bool // program files already known about
+
+	lastSyncStatusMu sync.Mutex
+	lastSyncStatus   error // most recent error seen while syncing confDir
+
+	stopOnce sync.Once
+	done     chan struct{}
+	quit     chan struct{} // closed at the start of Close, to abort a pending send on events
+}
+
+// NewConfWatcher returns a ConfWatcher for confDir, or an error if confDir
+// cannot be watched.  check, if non-nil, is consulted before a
+// ProgramAdded or ProgramChanged event is emitted; debounce coalesces the
+// burst of fsnotify events an editor's write-then-rename save produces. A
+// zero debounce uses a default of 500ms.
+func NewConfWatcher(confDir string, check ProgramChecker, debounce time.Duration) (*ConfWatcher, error) {
+	if debounce == 0 {
+		debounce = 500 * time.Millisecond
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating fsnotify watcher")
+	}
+	if err := fw.Add(confDir); err != nil {
+		fw.Close()
+		return nil, errors.Wrapf(err, "watching program directory %q", confDir)
+	}
+	w := &ConfWatcher{
+		confDir:  confDir,
+		check:    check,
+		debounce: debounce,
+		watcher:  fw,
+		events:   make(chan ProgramEvent),
+		pending:  make(map[string]*time.Timer),
+		seen:     make(map[string]bool),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	entries, err := readDirNames(confDir)
+	if err != nil {
+		fw.Close()
+		return nil, errors.Wrapf(err, "listing program directory %q", confDir)
+	}
+	for _, name := range entries {
+		if strings.HasSuffix(name, programSuffix) {
+			w.seen[filepath.Join(confDir, name)] = true
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Events returns the channel of ProgramEvents emitted as program files
+// change.  It is closed when the ConfWatcher is closed.
+func (w *ConfWatcher) Events() <-chan ProgramEvent {
+	return w.events
+}
+
+// LastSyncStatus returns the error, if any, from the most recently
+// processed fsnotify event or syntax check.
+func (w *ConfWatcher) LastSyncStatus() error {
+	w.lastSyncStatusMu.Lock()
+	defer w.lastSyncStatusMu.Unlock()
+	return w.lastSyncStatus
+}
+
+func (w *ConfWatcher) setLastSyncStatus(err error) {
+	w.lastSyncStatusMu.Lock()
+	w.lastSyncStatus = err
+	w.lastSyncStatusMu.Unlock()
+}
+
+func (w *ConfWatcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handleFsEvent(e)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("ConfWatcher fsnotify error: %s", err)
+			w.setLastSyncStatus(err)
+		}
+	}
+}
+
+func (w *ConfWatcher) handleFsEvent(e fsnotify.Event) {
+	if !strings.HasSuffix(e.Name, programSuffix) {
+		return
+	}
+	switch {
+	case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		w.cancelPending(e.Name)
+		if _, err := os.Stat(e.Name); err != nil {
+			w.seenMu.Lock()
+			delete(w.seen, e.Name)
+			w.seenMu.Unlock()
+			select {
+			case w.events <- ProgramEvent{ProgramRemoved, e.Name}:
+			case <-w.quit:
+			}
+		}
+	case e.Op&(fsnotify.Write|fsnotify.Create) != 0:
+		w.debounceSync(e.Name)
+	}
+}
+
+// debounceSync (re)starts the debounce timer for pathname, so that a burst
+// of saves collapses into a single syntax check and event.
+func (w *ConfWatcher) debounceSync(pathname string) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if t, ok := w.pending[pathname]; ok {
+		if t.Stop() {
+			w.syncWG.Done()
+		}
+	}
+	w.syncWG.Add(1)
+	w.pending[pathname] = time.AfterFunc(w.debounce, func() {
+		w.pendingMu.Lock()
+		delete(w.pending, pathname)
+		w.pendingMu.Unlock()
+		defer w.syncWG.Done()
+		w.syncProgram(pathname)
+	})
+}
+
+func (w *ConfWatcher) cancelPending(pathname string) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if t, ok := w.pending[pathname]; ok {
+		if t.Stop() {
+			w.syncWG.Done()
+		}
+		delete(w.pending, pathname)
+	}
+}
+
+// syncProgram runs once the debounce timer for pathname fires.  It
+// syntax-checks the new source, leaving the previously compiled program
+// live and counting a reload error if the check fails, and otherwise
+// emits ProgramAdded or ProgramChanged as appropriate.
+func (w *ConfWatcher) syncProgram(pathname string) {
+	if _, err := os.Stat(pathname); err != nil {
+		// Removed again before the debounce fired; handleFsEvent's Remove
+		// case will have already dealt with it, or will shortly.
+		return
+	}
+	if w.check != nil {
+		if err := w.check(pathname); err != nil {
+			programReloadErrors.Add(1)
+			w.setLastSyncStatus(err)
+			glog.Infof("Not reloading %q, syntax check failed: %s", pathname, err)
+			return
+		}
+	}
+	w.setLastSyncStatus(nil)
+	op := ProgramChanged
+	w.seenMu.Lock()
+	if !w.seen[pathname] {
+		op = ProgramAdded
+		w.seen[pathname] = true
+	}
+	w.seenMu.Unlock()
+	select {
+	case w.events <- ProgramEvent{op, pathname}:
+	case <-w.quit:
+	}
+}
+
+// Close shuts down the ConfWatcher.  It is safe to call this from multiple
+// clients.
+func (w *ConfWatcher) Close() error {
+	var err error
+	w.stopOnce.Do(func() {
+		close(w.quit)
+		err = w.watcher.Close()
+		<-w.done
+		w.pendingMu.Lock()
+		for pathname, t := range w.pending {
+			if t.Stop() {
+				w.syncWG.Done()
+			}
+			delete(w.pending, pathname)
+		}
+		w.pendingMu.Unlock()
+		// Wait for any syncProgram call whose debounce timer had already
+		// fired before we could stop it, so it can't send on w.events
+		// concurrently with (or after) the close below.  quit, closed
+		// above, lets such a call abort its send instead of blocking
+		// forever on a consumer that has already stopped draining.
+		w.syncWG.Wait()
+		close(w.events)
+	})
+	return err
+}
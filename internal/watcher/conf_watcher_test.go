@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestConfWatcher(t *testing.T, check ProgramChecker, debounce time.Duration) (*ConfWatcher, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "conf_watcher_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	w, err := NewConfWatcher(dir, check, debounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, dir
+}
+
+func TestConfWatcherAddedAndChanged(t *testing.T) {
+	w, dir := newTestConfWatcher(t, nil, 10*time.Millisecond)
+	path := filepath.Join(dir, "test.mtail")
+
+	if err := ioutil.WriteFile(path, []byte("# v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		if e.Op != ProgramAdded || e.Pathname != path {
+			t.Errorf("got event %+v, want ProgramAdded for %q", e, path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for ProgramAdded")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("# v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		if e.Op != ProgramChanged || e.Pathname != path {
+			t.Errorf("got event %+v, want ProgramChanged for %q", e, path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for ProgramChanged")
+	}
+}
+
+func TestConfWatcherFailedCheckSuppressesEvent(t *testing.T) {
+	check := func(pathname string) error { return os.ErrInvalid }
+	w, dir := newTestConfWatcher(t, check, 10*time.Millisecond)
+	path := filepath.Join(dir, "bad.mtail")
+
+	if err := ioutil.WriteFile(path, []byte("# broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		t.Fatalf("got unexpected event %+v, want none since the syntax check failed", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := w.LastSyncStatus(); err == nil {
+		t.Error("LastSyncStatus() = nil, want the syntax check error")
+	}
+}
+
+// TestConfWatcherCloseDuringDebounce exercises Close racing with a
+// debounce timer that has already fired and is running syncProgram, which
+// must not be able to send on (or be preempted by the close of) the
+// events channel.
+func TestConfWatcherCloseDuringDebounce(t *testing.T) {
+	w, dir := newTestConfWatcher(t, nil, 1*time.Millisecond)
+	path := filepath.Join(dir, "test.mtail")
+	if err := ioutil.WriteFile(path, []byte("# v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for range w.Events() {
+		}
+	}()
+
+	// Give the debounce timer a moment to fire and start racing Close.
+	time.Sleep(2 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the events channel to be drained and closed")
+	}
+}
+
+// TestConfWatcherCloseWithNoDrainerDoesNotDeadlock exercises Close racing
+// with a debounce timer that has already fired and is blocked trying to
+// send on events, with nothing reading from it at all.  Without an
+// abortable send, this wedges syncProgram forever and Close hangs on
+// syncWG.Wait().
+func TestConfWatcherCloseWithNoDrainerDoesNotDeadlock(t *testing.T) {
+	w, dir := newTestConfWatcher(t, nil, 1*time.Millisecond)
+	path := filepath.Join(dir, "test.mtail")
+	if err := ioutil.WriteFile(path, []byte("# v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the debounce timer a moment to fire and block on the send,
+	// with no goroutine ever draining w.Events().
+	time.Sleep(2 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() did not return; syncProgram is likely wedged sending on events")
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import "os"
+
+// readDirNames returns the names of the entries in the directory at path.
+func readDirNames(path string) ([]string, error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
@@ -1,10 +1,11 @@
 // Copyright 2015 Google Inc. All Rights Reserved.
 // This file is available under the Apache license.
 
+// +build !darwin
+
 package watcher
 
 import (
-	"expvar"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,12 +17,9 @@ import (
 	"github.com/pkg/errors"
 )
 
-var (
-	eventCount = expvar.NewMap("log_watcher_event_count")
-	errorCount = expvar.NewInt("log_watcher_error_count")
-)
-
-// LogWatcher implements a Watcher for watching real filesystems.
+// LogWatcher implements a Watcher for watching real filesystems, using
+// fsnotify to receive events plus a poll ticker as a fallback.  Darwin uses
+// a native kqueue backend instead; see log_watcher_darwin.go.
 type LogWatcher struct {
 	watcher    *fsnotify.Watcher
 	pollTicker *time.Ticker
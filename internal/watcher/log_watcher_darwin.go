@@ -0,0 +1,370 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build darwin
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// reopenDebounce is how long to wait after a NOTE_DELETE or NOTE_RENAME
+// before attempting to reopen the watched path, to give a rename-into-place
+// save a chance to settle.
+const reopenDebounce = 50 * time.Millisecond
+
+// kqueueWatch describes one vnode watch registered with kq, kept in byFd so
+// we can translate fd-based events back into the pathname the rest of
+// mtail expects.
+type kqueueWatch struct {
+	fd      int
+	path    string
+	isDir   bool
+	entries map[string]bool // last known directory entries, for isDir watches
+}
+
+// LogWatcher implements a Watcher for watching real filesystems on Darwin,
+// using kqueue's EVFILT_VNODE directly rather than fsnotify, which on
+// Darwin misses many rename/rotate cases. Linux keeps the fsnotify-based
+// backend in log_watcher.go.
+type LogWatcher struct {
+	kq int
+
+	pollTicker *time.Ticker
+
+	eventsMu sync.RWMutex
+	events   []chan Event
+
+	watchedMu sync.RWMutex          // protects `watched' and `byFd'
+	watched   map[string]chan Event // Names of paths being watched
+	byFd      map[int]*kqueueWatch  // open watches, keyed by fd
+
+	stopTicks chan struct{}
+	ticksDone chan struct{}
+
+	stopKevents chan struct{}
+	keventsDone chan struct{}
+
+	closeOnce sync.Once
+}
+
+// NewLogWatcher returns a new kqueue-backed LogWatcher, or returns an error.
+// enableFsnotify, as on Linux, selects the event-driven backend; when false
+// only the poll ticker is used.
+func NewLogWatcher(pollInterval time.Duration, enableFsnotify bool) (*LogWatcher, error) {
+	w := &LogWatcher{
+		events:  make([]chan Event, 0),
+		watched: make(map[string]chan Event),
+		byFd:    make(map[int]*kqueueWatch),
+	}
+	if enableFsnotify {
+		kq, err := syscall.Kqueue()
+		if err != nil {
+			return nil, errors.Wrap(err, "kqueue")
+		}
+		w.kq = kq
+		w.stopKevents = make(chan struct{})
+		w.keventsDone = make(chan struct{})
+		go w.runKevents()
+	} else {
+		w.kq = -1
+	}
+	if pollInterval == 0 && w.kq < 0 {
+		pollInterval = time.Millisecond * 250
+	}
+	if pollInterval > 0 {
+		w.pollTicker = time.NewTicker(pollInterval)
+		w.stopTicks = make(chan struct{})
+		w.ticksDone = make(chan struct{})
+		go w.runTicks()
+	}
+	return w, nil
+}
+
+// Events returns a new readable channel of events from this watcher.
+func (w *LogWatcher) Events() (int, <-chan Event) {
+	w.eventsMu.Lock()
+	handle := len(w.events)
+	ch := make(chan Event)
+	w.events = append(w.events, ch)
+	w.eventsMu.Unlock()
+	return handle, ch
+}
+
+func (w *LogWatcher) sendEvent(e Event) {
+	w.watchedMu.RLock()
+	c, ok := w.watched[e.Pathname]
+	w.watchedMu.RUnlock()
+	if !ok {
+		d := filepath.Dir(e.Pathname)
+		w.watchedMu.RLock()
+		c, ok = w.watched[d]
+		w.watchedMu.RUnlock()
+	}
+	if ok {
+		c <- e
+		return
+	}
+	glog.V(2).Infof("No channel for path %q", e.Pathname)
+}
+
+func (w *LogWatcher) runTicks() {
+	defer close(w.ticksDone)
+
+	if w.pollTicker == nil {
+		return
+	}
+
+Exit:
+	for {
+		select {
+		case <-w.pollTicker.C:
+			w.watchedMu.RLock()
+			for n, c := range w.watched {
+				c <- Event{Update, n}
+			}
+			w.watchedMu.RUnlock()
+		case <-w.stopTicks:
+			w.pollTicker.Stop()
+			break Exit
+		}
+	}
+}
+
+// runKevents runs the kevent loop, translating EVFILT_VNODE events on our
+// watched fds into the module's Event type.  Assumes w.kq is a valid kqueue.
+func (w *LogWatcher) runKevents() {
+	defer close(w.keventsDone)
+
+	changes := make([]syscall.Kevent_t, 0)
+	events := make([]syscall.Kevent_t, 16)
+	timeout := syscall.NsecToTimespec(int64(time.Second))
+
+	for {
+		select {
+		case <-w.stopKevents:
+			return
+		default:
+		}
+		n, err := syscall.Kevent(w.kq, changes, events, &timeout)
+		changes = changes[:0]
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			errorCount.Add(1)
+			glog.Errorf("kevent error: %s", err)
+			continue
+		}
+		for i := 0; i < n; i++ {
+			w.handleKevent(&events[i])
+		}
+	}
+}
+
+func (w *LogWatcher) handleKevent(ev *syscall.Kevent_t) {
+	fd := int(ev.Ident)
+	w.watchedMu.RLock()
+	kw, ok := w.byFd[fd]
+	w.watchedMu.RUnlock()
+	if !ok {
+		return
+	}
+	eventCount.Add(kw.path, 1)
+	fflags := ev.Fflags
+
+	switch {
+	case fflags&(syscall.NOTE_DELETE|syscall.NOTE_RENAME) != 0:
+		glog.V(2).Infof("kqueue saw delete/rename on %q", kw.path)
+		w.sendEvent(Event{Delete, kw.path})
+		go w.reopen(kw)
+	case fflags&syscall.NOTE_WRITE != 0 && kw.isDir:
+		w.scanDir(kw)
+	case fflags&(syscall.NOTE_WRITE|syscall.NOTE_EXTEND) != 0:
+		w.sendEvent(Event{Update, kw.path})
+	case fflags&syscall.NOTE_ATTRIB != 0:
+		w.sendEvent(Event{Update, kw.path})
+	}
+}
+
+// reopen is called after a NOTE_DELETE or NOTE_RENAME fires on kw's fd. It
+// waits out reopenDebounce to let a rename-into-place save settle, then
+// re-opens the path and re-registers the vnode watch on the new fd, since
+// kqueue watches are per-fd and the old fd no longer refers to this name.
+func (w *LogWatcher) reopen(kw *kqueueWatch) {
+	time.Sleep(reopenDebounce)
+
+	w.watchedMu.Lock()
+	delete(w.byFd, kw.fd)
+	w.watchedMu.Unlock()
+	syscall.Close(kw.fd)
+
+	newFd, err := syscall.Open(kw.path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		glog.V(2).Infof("Could not reopen %q after rotation: %s", kw.path, err)
+		return
+	}
+	kw.fd = newFd
+	w.watchedMu.Lock()
+	w.byFd[newFd] = kw
+	w.watchedMu.Unlock()
+	if err := w.registerVnodeWatch(newFd); err != nil {
+		glog.Infof("Could not re-register watch on %q: %s", kw.path, err)
+		return
+	}
+	// The file at this pathname is new; tell the reader to reopen it too.
+	w.sendEvent(Event{Create, kw.path})
+}
+
+// scanDir looks for newly-created entries in a watched directory and
+// issues synthetic Create events for any not seen before, since kqueue
+// delivers directory NOTE_WRITE events without telling us what changed.
+func (w *LogWatcher) scanDir(kw *kqueueWatch) {
+	entries, err := readDirNames(kw.path)
+	if err != nil {
+		glog.V(2).Infof("Could not scan directory %q: %s", kw.path, err)
+		return
+	}
+	for _, name := range entries {
+		if kw.entries[name] {
+			continue
+		}
+		kw.entries[name] = true
+		w.sendEvent(Event{Create, filepath.Join(kw.path, name)})
+	}
+}
+
+func (w *LogWatcher) registerVnodeWatch(fd int) error {
+	changes := []syscall.Kevent_t{{
+		Ident:  uint64(fd),
+		Filter: syscall.EVFILT_VNODE,
+		Flags:  syscall.EV_ADD | syscall.EV_CLEAR,
+		Fflags: syscall.NOTE_WRITE | syscall.NOTE_EXTEND | syscall.NOTE_DELETE | syscall.NOTE_RENAME | syscall.NOTE_ATTRIB,
+	}}
+	_, err := syscall.Kevent(w.kq, changes, nil, nil)
+	return err
+}
+
+// Close shuts down the LogWatcher.  It is safe to call this from multiple clients.
+func (w *LogWatcher) Close() (err error) {
+	w.closeOnce.Do(func() {
+		if w.stopKevents != nil {
+			close(w.stopKevents)
+			<-w.keventsDone
+		}
+		w.watchedMu.Lock()
+		for fd := range w.byFd {
+			syscall.Close(fd)
+		}
+		w.watchedMu.Unlock()
+		if w.kq >= 0 {
+			syscall.Close(w.kq)
+		}
+		if w.pollTicker != nil {
+			close(w.stopTicks)
+			<-w.ticksDone
+		}
+		glog.Info("Closing events channels")
+		w.eventsMu.Lock()
+		for _, c := range w.events {
+			close(c)
+		}
+		w.eventsMu.Unlock()
+	})
+	return nil
+}
+
+// Add adds a path to the list of watched items.
+// If the path is already being watched, then nothing is changed -- the new handle does not replace the old one.
+func (w *LogWatcher) Add(path string, handle int) error {
+	w.eventsMu.RLock()
+	if handle > len(w.events) {
+		return errors.Errorf("no such event handle %d", handle)
+	}
+	w.eventsMu.RUnlock()
+	if w.IsWatching(path) {
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lookup absolutepath of %q", path)
+	}
+	if absPath == "/dev" {
+		glog.V(2).Info("Skipping adding watch on /dev")
+	} else if w.kq >= 0 {
+		fd, ferr := syscall.Open(absPath, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+		if ferr != nil {
+			if os.IsPermission(ferr) {
+				glog.V(2).Infof("Skipping permission denied error on adding a watch on %q", absPath)
+			} else {
+				return errors.Wrapf(ferr, "Failed to open %q for watching", absPath)
+			}
+		} else {
+			kw := &kqueueWatch{fd: fd, path: absPath}
+			var stat syscall.Stat_t
+			if serr := syscall.Fstat(fd, &stat); serr == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+				kw.isDir = true
+				kw.entries = make(map[string]bool)
+				if names, derr := readDirNames(absPath); derr == nil {
+					for _, n := range names {
+						kw.entries[n] = true
+					}
+				}
+			}
+			if rerr := w.registerVnodeWatch(fd); rerr != nil {
+				syscall.Close(fd)
+				return errors.Wrapf(rerr, "Failed to create a new watch on %q", absPath)
+			}
+			w.watchedMu.Lock()
+			w.byFd[fd] = kw
+			w.watchedMu.Unlock()
+		}
+	}
+	w.watchedMu.Lock()
+	w.eventsMu.RLock()
+	w.watched[absPath] = w.events[handle]
+	w.eventsMu.RUnlock()
+	w.watchedMu.Unlock()
+	return nil
+}
+
+// IsWatching indicates if the path is being watched. It includes both
+// filenames and directories.
+func (w *LogWatcher) IsWatching(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		glog.V(2).Infof("Couldn't resolve path %q: %s", absPath, err)
+		return false
+	}
+	glog.V(2).Infof("Resolved path for lookup %q", absPath)
+	w.watchedMu.RLock()
+	_, ok := w.watched[absPath]
+	w.watchedMu.RUnlock()
+	return ok
+}
+
+func (w *LogWatcher) Remove(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	w.watchedMu.Lock()
+	delete(w.watched, absPath)
+	for fd, kw := range w.byFd {
+		if kw.path == absPath {
+			syscall.Close(fd)
+			delete(w.byFd, fd)
+			break
+		}
+	}
+	w.watchedMu.Unlock()
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import "expvar"
+
+var (
+	eventCount = expvar.NewMap("log_watcher_event_count")
+	errorCount = expvar.NewInt("log_watcher_error_count")
+)